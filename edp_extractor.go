@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// edpExtractor parses key fields out of an EDP electricity invoice PDF
+// using anchor regexes against the PDF's extracted plain text. EDP
+// invoices follow a fairly stable layout, so a handful of anchors cover
+// the fields needed for expense tracking.
+type edpExtractor struct {
+	invoiceNumberRegex *regexp.Regexp
+	issueDateRegex     *regexp.Regexp
+	dueDateRegex       *regexp.Regexp
+	billingPeriodRegex *regexp.Regexp
+	consumptionRegex   *regexp.Regexp
+	totalRegex         *regexp.Regexp
+	vatRegex           *regexp.Regexp
+}
+
+func newEDPExtractor() *edpExtractor {
+	return &edpExtractor{
+		invoiceNumberRegex: regexp.MustCompile(`(?i)N\S?\s*(?:da\s+)?Fatura[:\s]+([A-Z0-9/-]+)`),
+		issueDateRegex:     regexp.MustCompile(`(?i)Data\s+(?:de\s+)?emiss[aã]o[:\s]+(\d{2}[-/]\d{2}[-/]\d{4})`),
+		dueDateRegex:       regexp.MustCompile(`(?i)Data\s+(?:limite\s+de\s+)?pagamento[:\s]+(\d{2}[-/]\d{2}[-/]\d{4})`),
+		billingPeriodRegex: regexp.MustCompile(`(?i)Per[ií]odo\s+de\s+factura[çc][aã]o[:\s]+(\d{2}[-/]\d{2}[-/]\d{4})\s*a\s*(\d{2}[-/]\d{2}[-/]\d{4})`),
+		consumptionRegex:   regexp.MustCompile(`(?i)([\d.,]+)\s*kWh`),
+		totalRegex:         regexp.MustCompile(`(?i)Total\s+a\s+pagar[:\s]+([\d.,]+)\s*€?`),
+		vatRegex:           regexp.MustCompile(`(?i)IVA[:\s]+([\d.,]+)\s*€?`),
+	}
+}
+
+func (e *edpExtractor) Provider() string {
+	return "edp"
+}
+
+func (e *edpExtractor) Extract(text string) (InvoiceData, error) {
+	var data InvoiceData
+
+	if m := e.invoiceNumberRegex.FindStringSubmatch(text); len(m) > 1 {
+		data.InvoiceNumber = strings.TrimSpace(m[1])
+	}
+	if m := e.issueDateRegex.FindStringSubmatch(text); len(m) > 1 {
+		data.IssueDate = normalizePTDate(m[1])
+	}
+	if m := e.dueDateRegex.FindStringSubmatch(text); len(m) > 1 {
+		data.DueDate = normalizePTDate(m[1])
+	}
+	if m := e.billingPeriodRegex.FindStringSubmatch(text); len(m) > 2 {
+		data.BillingPeriod = fmt.Sprintf("%s/%s", normalizePTDate(m[1]), normalizePTDate(m[2]))
+	}
+	if m := e.consumptionRegex.FindStringSubmatch(text); len(m) > 1 {
+		if v, err := parsePTNumber(m[1]); err == nil {
+			data.ConsumptionKWh = v
+		}
+	}
+
+	m := e.totalRegex.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return data, fmt.Errorf("unable to find the total amount in the invoice text")
+	}
+	total, err := parsePTNumber(m[1])
+	if err != nil {
+		return data, fmt.Errorf("unable to parse the total amount %q: %w", m[1], err)
+	}
+	data.TotalEUR = total
+
+	if m := e.vatRegex.FindStringSubmatch(text); len(m) > 1 {
+		if v, err := parsePTNumber(m[1]); err == nil {
+			data.VATEUR = v
+		}
+	}
+
+	return data, nil
+}
+
+// normalizePTDate converts a dd-mm-yyyy or dd/mm/yyyy date to YYYY-MM-DD.
+func normalizePTDate(s string) string {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '/' })
+	if len(parts) != 3 {
+		return s
+	}
+	return fmt.Sprintf("%s-%s-%s", parts[2], parts[1], parts[0])
+}
+
+// parsePTNumber parses a Portuguese-formatted number (using "," as the
+// decimal separator and "." as the thousands separator) into a float64.
+func parsePTNumber(s string) (float64, error) {
+	s = strings.ReplaceAll(s, ".", "")
+	s = strings.ReplaceAll(s, ",", ".")
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// edpFromAddress is the sender EDP invoices are delivered from.
+const edpFromAddress = "faturaedp@edp.pt"
+
+// edpProvider archives invoices from EDP, the Portuguese electricity
+// utility this tool was originally built for.
+type edpProvider struct {
+	// e.g. A sua fatura EDP (contrato 100200300200)
+	contractSubjectRegex *regexp.Regexp
+	// e.g. 187008571923.pdf
+	invoiceFilenameRegex *regexp.Regexp
+}
+
+func newEDPProvider() *edpProvider {
+	return &edpProvider{
+		contractSubjectRegex: regexp.MustCompile(`\(contrato (\d+)\)`),
+		invoiceFilenameRegex: regexp.MustCompile(`^\d+\.pdf$`),
+	}
+}
+
+func (p *edpProvider) Name() string {
+	return "edp"
+}
+
+func (p *edpProvider) SearchQuery() string {
+	// see search google for "Gmail search box"
+	// see Refine searches in Gmail at https://support.google.com/mail/answer/7190?hl=en
+	return encodeQuery(map[string]string{
+		"from": edpFromAddress,
+		"has":  "attachment",
+	})
+}
+
+// MatchMessage reports whether msg's From header is EDP's invoice sender,
+// mirroring the "from:" restriction SearchQuery applies during a full
+// sync.
+func (p *edpProvider) MatchMessage(msg *gmail.Message) bool {
+	return strings.Contains(headerValue(msg, "From"), edpFromAddress)
+}
+
+func (p *edpProvider) MatchAttachment(part *gmail.MessagePart) bool {
+	return part.MimeType == "application/pdf" && p.invoiceFilenameRegex.MatchString(part.Filename)
+}
+
+func (p *edpProvider) DeriveFilename(msg *gmail.Message, cfg *Configuration) string {
+	date := formatDate(msg.InternalDate)
+
+	filenamePrefix := fmt.Sprintf("%s-%s", date, msg.Id)
+	if contract := p.ContractID(msg); contract != "" {
+		filenamePrefix = fmt.Sprintf("%s-edp-%s", date, contract)
+		if alias, ok := cfg.Contracts[p.Name()][contract]; ok {
+			filenamePrefix = fmt.Sprintf("%s-%s", filenamePrefix, alias)
+		}
+	}
+	return filenamePrefix
+}
+
+// ContractID extracts the contract id from the "(contrato NNN)" suffix
+// EDP appends to the invoice subject, e.g. "A sua fatura EDP (contrato
+// 100200300200)". It returns "" if the subject doesn't match.
+func (p *edpProvider) ContractID(msg *gmail.Message) string {
+	matches := p.contractSubjectRegex.FindStringSubmatch(headerValue(msg, "Subject"))
+	if len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
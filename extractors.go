@@ -0,0 +1,40 @@
+package main
+
+// InvoiceData holds the fields extracted from an invoice PDF.
+type InvoiceData struct {
+	InvoiceNumber  string
+	IssueDate      string // YYYY-MM-DD
+	DueDate        string // YYYY-MM-DD
+	BillingPeriod  string // YYYY-MM-DD/YYYY-MM-DD
+	ConsumptionKWh float64
+	TotalEUR       float64
+	VATEUR         float64
+}
+
+// Extractor pulls structured invoice fields out of a provider's PDF
+// attachment text. Registering an Extractor in registeredExtractors adds
+// it to the invoices.csv/invoices.jsonl ledger for that provider.
+type Extractor interface {
+	// Provider is the name of the Provider (see providers.go) this
+	// extractor knows how to read invoices for.
+	Provider() string
+	// Extract parses the invoice fields out of the PDF's plain text.
+	Extract(text string) (InvoiceData, error)
+}
+
+// registeredExtractors lists every Extractor this tool knows how to run.
+// A provider without a matching extractor is still archived as usual;
+// it simply isn't added to the ledger.
+var registeredExtractors = []Extractor{
+	newEDPExtractor(),
+}
+
+// extractorFor returns the Extractor registered for providerName, if any.
+func extractorFor(providerName string) (Extractor, bool) {
+	for _, e := range registeredExtractors {
+		if e.Provider() == providerName {
+			return e, true
+		}
+	}
+	return nil, false
+}
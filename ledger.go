@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+const (
+	ledgerCSVFile   = "invoices.csv"
+	ledgerJSONLFile = "invoices.jsonl"
+)
+
+// appendInvoiceLedger extracts the invoice fields out of a PDF attachment's
+// data using extractor and appends the result to invoices.csv and
+// invoices.jsonl. Extraction failures are logged and otherwise ignored,
+// consistent with how a single bad attachment never aborts the sync.
+func appendInvoiceLedger(extractor Extractor, data []byte, messageID, providerName, contract, alias string) {
+	text, err := extractPDFText(data)
+	if err != nil {
+		log.Printf("Unable to extract PDF text for message %v: %v", messageID, err)
+		return
+	}
+	invoice, err := extractor.Extract(text)
+	if err != nil {
+		log.Printf("Unable to extract invoice fields for message %v: %v", messageID, err)
+		return
+	}
+
+	record := InvoiceRecord{
+		MessageID:      messageID,
+		Provider:       providerName,
+		Contract:       contract,
+		Alias:          alias,
+		InvoiceNumber:  invoice.InvoiceNumber,
+		IssueDate:      invoice.IssueDate,
+		DueDate:        invoice.DueDate,
+		BillingPeriod:  invoice.BillingPeriod,
+		ConsumptionKWh: invoice.ConsumptionKWh,
+		TotalEUR:       invoice.TotalEUR,
+		VATEUR:         invoice.VATEUR,
+	}
+	if err := appendLedgerCSV(ledgerCSVFile, record); err != nil {
+		log.Printf("Unable to append to %s for message %v: %v", ledgerCSVFile, messageID, err)
+	}
+	if err := appendLedgerJSONL(ledgerJSONLFile, record); err != nil {
+		log.Printf("Unable to append to %s for message %v: %v", ledgerJSONLFile, messageID, err)
+	}
+}
+
+// InvoiceRecord is one row of the invoices ledger, combining the fields
+// extracted from an invoice PDF with the contract/alias it belongs to.
+type InvoiceRecord struct {
+	MessageID      string  `json:"messageId"`
+	Provider       string  `json:"provider"`
+	Contract       string  `json:"contract"`
+	Alias          string  `json:"alias"`
+	InvoiceNumber  string  `json:"invoiceNumber"`
+	IssueDate      string  `json:"issueDate"`
+	DueDate        string  `json:"dueDate"`
+	BillingPeriod  string  `json:"billingPeriod"`
+	ConsumptionKWh float64 `json:"consumptionKWh"`
+	TotalEUR       float64 `json:"totalEUR"`
+	VATEUR         float64 `json:"vatEUR"`
+}
+
+// ledgerCSVHeader is the header row written to a new invoices.csv.
+var ledgerCSVHeader = []string{
+	"messageId", "provider", "contract", "alias", "invoiceNumber",
+	"issueDate", "dueDate", "billingPeriod", "consumptionKWh", "totalEUR", "vatEUR",
+}
+
+func (r InvoiceRecord) csvRow() []string {
+	return []string{
+		r.MessageID, r.Provider, r.Contract, r.Alias, r.InvoiceNumber,
+		r.IssueDate, r.DueDate, r.BillingPeriod,
+		strconv.FormatFloat(r.ConsumptionKWh, 'f', -1, 64),
+		strconv.FormatFloat(r.TotalEUR, 'f', -1, 64),
+		strconv.FormatFloat(r.VATEUR, 'f', -1, 64),
+	}
+}
+
+// appendLedgerCSV appends record to filename, writing the header first if
+// the file doesn't already exist.
+func appendLedgerCSV(filename string, record InvoiceRecord) error {
+	writeHeader := false
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		writeHeader = true
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if writeHeader {
+		if err := w.Write(ledgerCSVHeader); err != nil {
+			return fmt.Errorf("unable to write the ledger header: %w", err)
+		}
+	}
+	if err := w.Write(record.csvRow()); err != nil {
+		return fmt.Errorf("unable to write the ledger row: %w", err)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// appendLedgerJSONL appends record to filename as a single JSON line.
+func appendLedgerJSONL(filename string, record InvoiceRecord) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to marshal the ledger record: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write the ledger record: %w", err)
+	}
+	return nil
+}
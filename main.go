@@ -2,27 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"gopkg.in/yaml.v3"
 )
 
 type Configuration struct {
-	Contracts map[string]string `yaml:"contracts"` // contract-id: alias
+	// Providers lists the enabled provider names (see registeredProviders
+	// in providers.go). Defaults to []string{"edp"} when empty, to match
+	// this tool's original single-purpose behavior.
+	Providers []string `yaml:"providers"`
+	// Contracts maps a provider name to its contract-id: alias mapping.
+	Contracts map[string]map[string]string `yaml:"contracts"`
 }
 
 // getConfiguration loads YAML data from a file and returns a Configuration object
@@ -50,41 +58,87 @@ func getClient(config *oauth2.Config) *http.Client {
 	tokFile := "token.json"
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
-		config.RedirectURL = "http://localhost:8080/oauth2/callback"
 		tok = getTokenFromWeb(config)
 		saveToken(tokFile, tok)
 	}
 	return config.Client(context.Background(), tok)
 }
 
+// oauthCallbackPath is the loopback path Google redirects back to once the
+// user has authorized the app.
+const oauthCallbackPath = "/oauth2/callback"
+
+// randomURLSafeString returns a base64url-encoded string of n random
+// bytes, suitable for an OAuth state or PKCE code_verifier.
+func randomURLSafeString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallengeS256 derives the PKCE S256 code_challenge for verifier.
+// see https://datatracker.ietf.org/doc/html/rfc7636#section-4.2
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
 // Request a token from the web, then returns the retrieved token.
+//
+// It binds the OAuth loopback callback to a dynamic port (so multiple
+// instances don't collide on a fixed one like 8080), verifies a random
+// per-request state to guard against CSRF, and uses PKCE (S256) as
+// recommended for installed apps that can't keep a client secret.
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-
-	// Parse the RedirectURL to get the callback path and server address.
-	redirectURL, err := url.Parse(config.RedirectURL)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Fatalf("Unable to parse RedirectURL: %v", err)
+		log.Fatalf("Unable to bind the OAuth loopback listener: %v", err)
 	}
-	serverAddr := redirectURL.Host
-	callbackPath := redirectURL.Path
+	config.RedirectURL = fmt.Sprintf("http://%s%s", listener.Addr(), oauthCallbackPath)
 
-	// Create a channel to receive the authorization code.
-	codeChan := make(chan string)
+	state, err := randomURLSafeString(32)
+	if err != nil {
+		log.Fatalf("Unable to generate the OAuth state: %v", err)
+	}
+	codeVerifier, err := randomURLSafeString(32)
+	if err != nil {
+		log.Fatalf("Unable to generate the PKCE code verifier: %v", err)
+	}
 
-	// Start a temporary HTTP server to handle the OAuth callback.
-	server := &http.Server{Addr: serverAddr}
-	http.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		codeChan <- code
+	authURL := config.AuthCodeURL(
+		state,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+
+	// Create channels to receive the authorization code, or a callback
+	// error (e.g. a state mismatch).
+	codeChan := make(chan string, 1)
+	errChan := make(chan error, 1)
+
+	// Register the callback on its own mux, rather than
+	// http.DefaultServeMux, so re-authenticating in the same process
+	// doesn't panic on duplicate route registration.
+	mux := http.NewServeMux()
+	server := &http.Server{Handler: mux}
+	mux.HandleFunc(oauthCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("state"); got != state {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			errChan <- fmt.Errorf("unexpected OAuth callback state %q", got)
+			return
+		}
 		fmt.Fprintf(w, "Authorization successful! You can close this window now.")
+		codeChan <- r.URL.Query().Get("code")
 		go func() {
 			server.Shutdown(context.Background())
 		}()
 	})
 	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("HTTP server ListenAndServe: %v", err)
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("HTTP server Serve: %v", err)
 		}
 	}()
 
@@ -96,9 +150,15 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 		fmt.Printf("Please open the following URL in your browser:\n%v\n", authURL)
 	}
 
-	// Wait for the authorization code.
-	authCode := <-codeChan
-	tok, err := config.Exchange(context.TODO(), authCode)
+	// Wait for the authorization code, or bail out on a callback error.
+	var authCode string
+	select {
+	case authCode = <-codeChan:
+	case err := <-errChan:
+		log.Fatalf("Unable to complete the OAuth callback: %v", err)
+	}
+
+	tok, err := config.Exchange(context.TODO(), authCode, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
 	if err != nil {
 		log.Fatalf("Unable to retrieve token from web: %v", err)
 	}
@@ -161,73 +221,183 @@ func formatDate(internalDateMs int64) string {
 	return t.Format("2006-01-02")
 }
 
-func saveAttachment(filename string, part *gmail.MessagePartBody) error {
+// saveAttachment decodes part and writes it to filename, returning the
+// decoded bytes so the caller can derive a checksum without re-reading
+// the file.
+func saveAttachment(filename string, part *gmail.MessagePartBody) ([]byte, error) {
 	data, err := base64.URLEncoding.DecodeString(part.Data)
 	if err != nil {
-		return fmt.Errorf("unable to decode attachment data: %v", err)
+		return nil, fmt.Errorf("unable to decode attachment data: %v", err)
 	}
 	err = os.WriteFile(filename, data, 0644)
 	if err != nil {
-		return fmt.Errorf("unable to write attachment file: %v", err)
+		return nil, fmt.Errorf("unable to write attachment file: %v", err)
 	}
-	return nil
+	return data, nil
 }
 
-func saveRawMessage(filename, rawContent string) error {
+// saveRawMessage decodes rawContent and writes it to filename, returning
+// the decoded bytes so the caller can derive a checksum without
+// re-reading the file.
+func saveRawMessage(filename, rawContent string) ([]byte, error) {
 	decodedContent, err := base64.URLEncoding.DecodeString(rawContent)
 	if err != nil {
-		return fmt.Errorf("unable to decode message content: %v", err)
+		return nil, fmt.Errorf("unable to decode message content: %v", err)
 	}
 	err = os.WriteFile(filename, decodedContent, 0644)
 	if err != nil {
-		return fmt.Errorf("unable to write raw message file: %v", err)
+		return nil, fmt.Errorf("unable to write raw message file: %v", err)
 	}
-	return nil
+	return decodedContent, nil
 }
 
-func main() {
-	configuration, err := getConfiguration("config.yaml")
-	if err != nil {
-		log.Fatalf("Unable to read the configuration: %v", err)
+// fetchMessage retrieves the full Gmail message with the given id.
+// see https://developers.google.com/gmail/api/reference/rest/v1/users.messages/get
+func fetchMessage(srv *gmail.Service, user, messageID string) (*gmail.Message, error) {
+	return srv.Users.Messages.Get(user, messageID).Format("full").Do()
+}
+
+// headerValue returns the value of msg's first header named name, or ""
+// if it isn't present.
+func headerValue(msg *gmail.Message, name string) string {
+	for _, header := range msg.Payload.Headers {
+		if header.Name == name {
+			return header.Value
+		}
 	}
+	return ""
+}
 
-	ctx := context.Background()
-	b, err := os.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+// matchingAttachment returns the first attachment part of msg that
+// provider recognizes as an invoice.
+func matchingAttachment(msg *gmail.Message, provider Provider) *gmail.MessagePart {
+	for _, part := range msg.Payload.Parts {
+		if provider.MatchAttachment(part) {
+			return part
+		}
 	}
+	return nil
+}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+// processMessage logs and archives a single Gmail message already
+// matched to provider, recording it in manifest so a later run can skip
+// it. It is shared by fullSync and incrementalSync so both code paths
+// archive messages identically. It returns false without touching the
+// filesystem if msg is already present in manifest, so reruns are
+// idempotent and cheap. It also returns false, without recording msg in
+// manifest, if any of its matched attachments failed to save, so a later
+// full sync archives it again. A later incrementalSync does not: the
+// historyId saved after this run is already past msg, so the history API
+// never returns it again.
+func processMessage(srv *gmail.Service, user string, configuration *Configuration, manifest *Manifest, provider Provider, msg *gmail.Message, messageIndex int) bool {
+	if _, archived := manifest.Messages[msg.Id]; archived {
+		return false
 	}
-	client := getClient(config)
 
-	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+	date := formatDate(msg.InternalDate)
+	var from string
+	var subject string
+	for _, header := range msg.Payload.Headers {
+		switch header.Name {
+		case "Subject":
+			subject = header.Value
+		case "From":
+			from = header.Value
+		}
 	}
 
-	// e.g. A sua fatura EDP (contrato 100200300200)
-	contractSubjectRegex := regexp.MustCompile(`\(contrato (\d+)\)`)
+	fmt.Printf("#%08d %s %s %s %s: %s\n", messageIndex, provider.Name(), msg.Id, date, from, subject)
 
-	// e.g. 187008571923.pdf
-	invoiceFilenameRegex := regexp.MustCompile(`^\d+\.pdf$`)
+	filenamePrefix := provider.DeriveFilename(msg, configuration)
+	contract := provider.ContractID(msg)
+	alias := configuration.Contracts[provider.Name()][contract]
 
-	user := "me"
+	var attachments []AttachmentMetadata
+	var attachmentData [][]byte
+	var matchedAttachments, savedAttachments int
+	for _, part := range msg.Payload.Parts {
+		if !provider.MatchAttachment(part) {
+			continue
+		}
+		matchedAttachments++
+
+		attachMsg, err := srv.Users.Messages.Attachments.Get(user, msg.Id, part.Body.AttachmentId).Do()
+		if err != nil {
+			log.Printf("Unable to retrieve message %v attachment %v: %v", msg.Id, part.Body.AttachmentId, err)
+			continue
+		}
+		filename := filenamePrefix + "-" + part.Filename
+		data, err := saveAttachment(filename, attachMsg)
+		if err != nil {
+			log.Printf("Unable to save message %v attachment %v: %v", msg.Id, part.Body.AttachmentId, err)
+			continue
+		}
+		savedAttachments++
+		attachments = append(attachments, AttachmentMetadata{
+			Filename:     filename,
+			AttachmentID: part.Body.AttachmentId,
+			Sha256:       sha256Hex(data),
+			Size:         len(data),
+		})
+		attachmentData = append(attachmentData, data)
+	}
+	if savedAttachments < matchedAttachments {
+		log.Printf("Message %v has %d attachment(s) that failed to save; not marking it archived so a later full sync retries it", msg.Id, matchedAttachments-savedAttachments)
+		return false
+	}
 
-	// see search google for "Gmail search box"
-	// see Refine searches in Gmail at https://support.google.com/mail/answer/7190?hl=en
-	searchParams := map[string]string{
-		"from": "faturaedp@edp.pt",
-		"has":  "attachment",
+	// see https://developers.google.com/gmail/api/reference/rest/v1/users.messages/get
+	rawMsg, err := srv.Users.Messages.Get(user, msg.Id).Format("raw").Do()
+	if err != nil {
+		log.Printf("Unable to retrieve raw message %v: %v", msg.Id, err)
+		return true
 	}
-	q := encodeQuery(searchParams)
+	emlPath := filenamePrefix + ".eml"
+	rawData, err := saveRawMessage(emlPath, rawMsg.Raw)
+	if err != nil {
+		log.Printf("Error saving message %v: %v", msg.Id, err)
+		return true
+	}
+
+	manifest.Messages[msg.Id] = InvoiceMetadata{
+		MessageID:    msg.Id,
+		ThreadID:     msg.ThreadId,
+		InternalDate: time.UnixMilli(msg.InternalDate).UTC(),
+		From:         from,
+		Subject:      subject,
+		Provider:     provider.Name(),
+		Contract:     contract,
+		Alias:        alias,
+		Attachments:  attachments,
+		EMLPath:      emlPath,
+		EMLSha256:    sha256Hex(rawData),
+		EMLSize:      len(rawData),
+	}
+	if err := saveSidecar(filenamePrefix, manifest.Messages[msg.Id]); err != nil {
+		log.Printf("Unable to save sidecar for message %v: %v", msg.Id, err)
+	}
+
+	// Only ledger attachments once the message is confirmed fully
+	// archived: appending earlier, inside the attachment loop, would add a
+	// duplicate row on a later retry of a message whose earlier attempt
+	// failed partway through (a bad attachment, or a failed raw-message
+	// fetch) after some attachments were already ledgered.
+	if extractor, ok := extractorFor(provider.Name()); ok {
+		for _, data := range attachmentData {
+			appendInvoiceLedger(extractor, data, msg.Id, provider.Name(), contract, alias)
+		}
+	}
+	return true
+}
 
+// fullSyncProvider lists every message matching provider's search query
+// and archives it, saving manifest to manifestFile after each newly
+// archived message so a crash mid-run doesn't lose earlier progress.
+func fullSyncProvider(srv *gmail.Service, user string, provider Provider, configuration *Configuration, manifest *Manifest, manifestFile string) error {
+	q := provider.SearchQuery()
 	messageIndex := 0
 	pageToken := ""
 	for {
-		// see Refine searches in Gmail at https://support.google.com/mail/answer/7190?hl=en
 		// see https://developers.google.com/gmail/api/reference/rest/v1/users.messages/list
 		req := srv.Users.Messages.List(user).Q(q)
 		if pageToken != "" {
@@ -236,7 +406,7 @@ func main() {
 
 		r, err := req.Do()
 		if err != nil {
-			log.Fatalf("Unable to retrieve messages: %v", err)
+			return fmt.Errorf("unable to retrieve messages: %w", err)
 		}
 
 		if len(r.Messages) == 0 {
@@ -244,67 +414,109 @@ func main() {
 		}
 
 		for _, m := range r.Messages {
-			// see https://developers.google.com/gmail/api/reference/rest/v1/users.messages/get
-			msg, err := srv.Users.Messages.Get(user, m.Id).Format("full").Do()
+			msg, err := fetchMessage(srv, user, m.Id)
 			if err != nil {
 				log.Printf("Unable to retrieve message %v: %v", m.Id, err)
 				continue
 			}
-
-			date := formatDate(msg.InternalDate)
-			var from string
-			var subject string
-			for _, header := range msg.Payload.Headers {
-				switch header.Name {
-				case "Subject":
-					subject = header.Value
-				case "From":
-					from = header.Value
+			if processMessage(srv, user, configuration, manifest, provider, msg, messageIndex) {
+				if err := saveManifest(manifestFile, manifest); err != nil {
+					log.Printf("Unable to save the manifest: %v", err)
 				}
 			}
+			messageIndex++
+		}
+
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	return nil
+}
+
+// fullSync runs fullSyncProvider for every enabled provider and returns
+// the historyId a later run can pass to incrementalSync to pick up from
+// where this sync started. That historyId is captured before
+// fullSyncProvider runs, not after: a full sync can take multiple pages
+// and a while to complete, and any message that arrives while it's
+// running would already be covered by a historyId captured afterward,
+// making incrementalSync skip it on the very next run. Capturing it first
+// means such a message is instead re-seen (and, thanks to the manifest,
+// cheaply skipped if it was already archived) by the next incrementalSync.
+func fullSync(srv *gmail.Service, user string, providers []Provider, configuration *Configuration, manifest *Manifest, manifestFile string) (uint64, error) {
+	// see https://developers.google.com/gmail/api/reference/rest/v1/users/getProfile
+	profile, err := srv.Users.GetProfile(user).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to retrieve profile: %w", err)
+	}
+
+	for _, provider := range providers {
+		if err := fullSyncProvider(srv, user, provider, configuration, manifest, manifestFile); err != nil {
+			return 0, fmt.Errorf("provider %s: %w", provider.Name(), err)
+		}
+	}
+
+	return profile.HistoryId, nil
+}
 
-			fmt.Printf("#%08d %s %s %s: %s\n", messageIndex, m.Id, date, from, subject)
+// incrementalSync fetches only the messages added since startHistoryId
+// using the Gmail history API and archives the ones whose attachments
+// match an enabled provider, saving manifest to manifestFile after each
+// newly archived message. It returns the account's new historyId. If
+// Gmail has expired the history (it only keeps ~1 week), this returns a
+// *googleapi.Error with Code 404 and the caller should fall back to
+// fullSync.
+func incrementalSync(srv *gmail.Service, user string, startHistoryId uint64, providers []Provider, configuration *Configuration, manifest *Manifest, manifestFile string) (uint64, error) {
+	messageIndex := 0
+	pageToken := ""
+	newHistoryId := startHistoryId
+	seen := map[string]bool{}
+	for {
+		// see https://developers.google.com/gmail/api/reference/rest/v1/users.history/list
+		req := srv.Users.History.List(user).StartHistoryId(startHistoryId).HistoryTypes("messageAdded")
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
 
-			filenamePrefix := date + "-" + m.Id
+		r, err := req.Do()
+		if err != nil {
+			return 0, err
+		}
 
-			matches := contractSubjectRegex.FindStringSubmatch(subject)
-			if len(matches) > 1 {
-				contract := matches[1]
-				filenamePrefix = fmt.Sprintf("%s-edp-%s", date, contract)
-				if alias, ok := configuration.Contracts[contract]; ok {
-					filenamePrefix = fmt.Sprintf("%s-%s", filenamePrefix, alias)
+		for _, h := range r.History {
+			for _, added := range h.MessagesAdded {
+				if seen[added.Message.Id] {
+					continue
 				}
-			}
+				seen[added.Message.Id] = true
 
-			for _, part := range msg.Payload.Parts {
-				if part.MimeType == "application/pdf" {
-					if invoiceFilenameRegex.MatchString(part.Filename) {
-						attachMsg, err := srv.Users.Messages.Attachments.Get(user, m.Id, part.Body.AttachmentId).Do()
-						if err != nil {
-							log.Printf("Unable to retrieve message %v attachment %v: %v", m.Id, part.Body.AttachmentId, err)
-							continue
-						}
-						err = saveAttachment(filenamePrefix+"-"+part.Filename, attachMsg)
-						if err != nil {
-							log.Printf("Unable to save message %v attachment %v: %v", m.Id, part.Body.AttachmentId, err)
-							continue
+				msg, err := fetchMessage(srv, user, added.Message.Id)
+				if err != nil {
+					log.Printf("Unable to retrieve message %v: %v", added.Message.Id, err)
+					continue
+				}
+
+				for _, provider := range providers {
+					if !provider.MatchMessage(msg) {
+						continue
+					}
+					if matchingAttachment(msg, provider) == nil {
+						continue
+					}
+					if processMessage(srv, user, configuration, manifest, provider, msg, messageIndex) {
+						if err := saveManifest(manifestFile, manifest); err != nil {
+							log.Printf("Unable to save the manifest: %v", err)
 						}
 					}
+					messageIndex++
+					break
 				}
 			}
+		}
 
-			// see https://developers.google.com/gmail/api/reference/rest/v1/users.messages/get
-			rawMsg, err := srv.Users.Messages.Get(user, m.Id).Format("raw").Do()
-			if err != nil {
-				log.Printf("Unable to retrieve raw message %v: %v", m.Id, err)
-				continue
-			}
-			err = saveRawMessage(filenamePrefix+".eml", rawMsg.Raw)
-			if err != nil {
-				log.Printf("Error saving message %v: %v", m.Id, err)
-			}
-
-			messageIndex++
+		if r.HistoryId > newHistoryId {
+			newHistoryId = r.HistoryId
 		}
 
 		if r.NextPageToken == "" {
@@ -312,4 +524,95 @@ func main() {
 		}
 		pageToken = r.NextPageToken
 	}
+
+	return newHistoryId, nil
+}
+
+func main() {
+	const manifestFile = "manifest.json"
+
+	if len(os.Args) > 1 && os.Args[1] == "--verify" {
+		manifest, err := getManifest(manifestFile)
+		if err != nil {
+			log.Fatalf("Unable to read the manifest: %v", err)
+		}
+		runVerify(manifest)
+		return
+	}
+
+	configuration, err := getConfiguration("config.yaml")
+	if err != nil {
+		log.Fatalf("Unable to read the configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	b, err := os.ReadFile("credentials.json")
+	if err != nil {
+		log.Fatalf("Unable to read client secret file: %v", err)
+	}
+
+	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	if err != nil {
+		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	}
+	client := getClient(config)
+
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+	}
+
+	providers, err := enabledProviders(configuration)
+	if err != nil {
+		log.Fatalf("Unable to resolve the enabled providers: %v", err)
+	}
+
+	user := "me"
+
+	const stateFile = "state.json"
+	state, err := getState(stateFile)
+	if err != nil {
+		log.Fatalf("Unable to read the sync state: %v", err)
+	}
+
+	manifest, err := getManifest(manifestFile)
+	if err != nil {
+		log.Fatalf("Unable to read the manifest: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "--watch" {
+		topicName := os.Getenv("GMAIL_WATCH_TOPIC")
+		projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+		subscriptionID := os.Getenv("GMAIL_WATCH_SUBSCRIPTION")
+		if topicName == "" || projectID == "" || subscriptionID == "" {
+			log.Fatalf("--watch requires GMAIL_WATCH_TOPIC, GOOGLE_CLOUD_PROJECT and GMAIL_WATCH_SUBSCRIPTION to be set")
+		}
+		if err := runWatch(ctx, srv, user, providers, topicName, projectID, subscriptionID, configuration, state, stateFile, manifest, manifestFile); err != nil {
+			log.Fatalf("Watch failed: %v", err)
+		}
+		return
+	}
+
+	var newHistoryId uint64
+	if startHistoryId, ok := state.Accounts[user]; ok {
+		newHistoryId, err = incrementalSync(srv, user, startHistoryId, providers, configuration, manifest, manifestFile)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			log.Printf("History %d has expired, falling back to a full sync", startHistoryId)
+			newHistoryId, err = fullSync(srv, user, providers, configuration, manifest, manifestFile)
+		}
+		if err != nil {
+			log.Fatalf("Unable to sync messages: %v", err)
+		}
+	} else {
+		newHistoryId, err = fullSync(srv, user, providers, configuration, manifest, manifestFile)
+		if err != nil {
+			log.Fatalf("Unable to sync messages: %v", err)
+		}
+	}
+
+	state.Accounts[user] = newHistoryId
+	if err := saveState(stateFile, state); err != nil {
+		log.Fatalf("Unable to save the sync state: %v", err)
+	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// AttachmentMetadata records one archived attachment's identity so a
+// --verify run can detect drift without re-downloading it.
+type AttachmentMetadata struct {
+	Filename     string `json:"filename"`
+	AttachmentID string `json:"attachmentId"`
+	Sha256       string `json:"sha256"`
+	Size         int    `json:"size"`
+}
+
+// InvoiceMetadata is the sidecar written alongside each archived message
+// (as "<prefix>.json"), and the record kept in the manifest so reruns can
+// tell whether a message has already been archived.
+type InvoiceMetadata struct {
+	MessageID    string               `json:"messageId"`
+	ThreadID     string               `json:"threadId"`
+	InternalDate time.Time            `json:"internalDate"`
+	From         string               `json:"from"`
+	Subject      string               `json:"subject"`
+	Provider     string               `json:"provider"`
+	Contract     string               `json:"contract,omitempty"`
+	Alias        string               `json:"alias,omitempty"`
+	Attachments  []AttachmentMetadata `json:"attachments,omitempty"`
+	EMLPath      string               `json:"emlPath"`
+	EMLSha256    string               `json:"emlSha256"`
+	EMLSize      int                  `json:"emlSize"`
+}
+
+// Manifest indexes every message this tool has archived, keyed by
+// message id, so reruns can skip messages that were already archived.
+type Manifest struct {
+	Messages map[string]InvoiceMetadata `json:"messages"`
+}
+
+// getManifest loads the manifest from filename. A missing file is not an
+// error: it simply means nothing has been archived yet.
+func getManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Manifest{Messages: map[string]InvoiceMetadata{}}, nil
+		}
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error unmarshaling manifest: %w", err)
+	}
+	if manifest.Messages == nil {
+		manifest.Messages = map[string]InvoiceMetadata{}
+	}
+	return &manifest, nil
+}
+
+// saveManifest persists the manifest to filename.
+func saveManifest(filename string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling manifest: %w", err)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	return nil
+}
+
+// sha256Hex returns the lowercase hex-encoded SHA-256 digest of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// saveSidecar writes metadata as "<prefix>.json" next to the files it describes.
+func saveSidecar(prefix string, metadata InvoiceMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling sidecar: %w", err)
+	}
+	if err := os.WriteFile(prefix+".json", data, 0644); err != nil {
+		return fmt.Errorf("error writing sidecar: %w", err)
+	}
+	return nil
+}
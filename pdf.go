@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// extractPDFText returns the plain text content of a PDF file's bytes.
+func extractPDFText(data []byte) (string, error) {
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("unable to read PDF: %w", err)
+	}
+	textReader, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("unable to extract PDF text: %w", err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, textReader); err != nil {
+		return "", fmt.Errorf("unable to read PDF text: %w", err)
+	}
+	return buf.String(), nil
+}
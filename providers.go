@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Provider knows how to find and name the invoice attachments from a
+// single biller (EDP, water, gas, telco, a bank, ...). Registering a
+// Provider in registeredProviders and enabling it by name in
+// config.yaml's providers list is all that's needed to archive a new
+// biller's invoices.
+type Provider interface {
+	// Name identifies the provider in config.yaml's providers and
+	// contracts sections.
+	Name() string
+	// SearchQuery is the Gmail search query (see
+	// https://support.google.com/mail/answer/7190) used to find this
+	// provider's messages during a full sync.
+	SearchQuery() string
+	// MatchMessage reports whether msg could plausibly be one of this
+	// provider's invoice emails (e.g. checking the From header), before
+	// MatchAttachment is consulted. SearchQuery already enforces this
+	// during a full sync, but incrementalSync walks every message added to
+	// the account, so it needs this check too to avoid archiving an
+	// unrelated numeric-named PDF from some other sender.
+	MatchMessage(msg *gmail.Message) bool
+	// MatchAttachment reports whether part is an invoice attachment this
+	// provider should archive.
+	MatchAttachment(part *gmail.MessagePart) bool
+	// DeriveFilename returns the archive filename prefix (without
+	// extension) for an invoice found in msg, using cfg for any
+	// configured contract alias.
+	DeriveFilename(msg *gmail.Message, cfg *Configuration) string
+	// ContractID returns the contract id msg belongs to, or "" if none
+	// could be identified. Used to look up a contract's alias and to
+	// populate the archived sidecar metadata.
+	ContractID(msg *gmail.Message) string
+}
+
+// registeredProviders lists every Provider this tool knows how to
+// archive. Enable one by name in config.yaml's providers list.
+var registeredProviders = []Provider{
+	newEDPProvider(),
+}
+
+// enabledProviders returns the Provider implementations named in
+// cfg.Providers. If cfg.Providers is empty, "edp" is enabled by default
+// to preserve this tool's original single-purpose behavior.
+func enabledProviders(cfg *Configuration) ([]Provider, error) {
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = []string{"edp"}
+	}
+
+	byName := make(map[string]Provider, len(registeredProviders))
+	for _, p := range registeredProviders {
+		byName[p.Name()] = p
+	}
+
+	providers := make([]Provider, 0, len(names))
+	for _, name := range names {
+		p, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown provider %q", name)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// State tracks Gmail sync progress so repeated runs only process new or
+// changed messages instead of re-scanning the full search query.
+type State struct {
+	// Accounts maps a Gmail user id (e.g. "me") to the last historyId
+	// that was fully processed for that account.
+	Accounts map[string]uint64 `json:"accounts"`
+}
+
+// getState loads the sync state from filename. A missing file is not an
+// error: it simply means no account has been synced yet.
+func getState(filename string) (*State, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{Accounts: map[string]uint64{}}, nil
+		}
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error unmarshaling state: %w", err)
+	}
+	if state.Accounts == nil {
+		state.Accounts = map[string]uint64{}
+	}
+	return &state, nil
+}
+
+// saveState persists the sync state to filename.
+func saveState(filename string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling state: %w", err)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	return nil
+}
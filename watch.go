@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/gmail/v1"
+)
+
+// watchRenewInterval is how often the Gmail watch is renewed. Google
+// expires a watch after 7 days, but renewing daily keeps us well clear of
+// that deadline even if a run is missed.
+const watchRenewInterval = 24 * time.Hour
+
+// pushNotification is the payload Gmail delivers on the Pub/Sub topic
+// registered by users.watch.
+// see https://developers.google.com/gmail/api/guides/push
+type pushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryId    uint64 `json:"historyId"`
+}
+
+// registerWatch calls users.watch for user and logs its expiration.
+// see https://developers.google.com/gmail/api/reference/rest/v1/users/watch
+func registerWatch(srv *gmail.Service, user, topicName string) (*gmail.WatchResponse, error) {
+	resp, err := srv.Users.Watch(user, &gmail.WatchRequest{
+		TopicName: topicName,
+		LabelIds:  []string{"INBOX"},
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to register watch: %w", err)
+	}
+	log.Printf("Watching %s, expires %s", user, time.UnixMilli(resp.Expiration))
+	return resp, nil
+}
+
+// runWatch runs the tool as a daemon: it registers a Gmail push watch on
+// topicName, consumes notifications from the Pub/Sub subscription
+// subscriptionID, and processes each one incrementally via
+// incrementalSync. The watch is renewed every watchRenewInterval and
+// stopped cleanly when ctx is canceled (e.g. by SIGINT/SIGTERM).
+func runWatch(ctx context.Context, srv *gmail.Service, user string, providers []Provider, topicName, projectID, subscriptionID string, configuration *Configuration, state *State, stateFile string, manifest *Manifest, manifestFile string) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	watchResp, err := registerWatch(srv, user, topicName)
+	if err != nil {
+		return err
+	}
+	if _, ok := state.Accounts[user]; !ok {
+		state.Accounts[user] = watchResp.HistoryId
+		if err := saveState(stateFile, state); err != nil {
+			log.Printf("Unable to save the sync state: %v", err)
+		}
+	}
+
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("unable to create Pub/Sub client: %w", err)
+	}
+	defer client.Close()
+	sub := client.Subscription(subscriptionID)
+
+	// sub.Receive invokes the callback below from up to
+	// ReceiveSettings.NumGoroutines goroutines at once (10 by default), but
+	// state.Accounts and manifest.Messages are plain maps, so every access
+	// to them here needs to be serialized.
+	var mu sync.Mutex
+
+	renewTicker := time.NewTicker(watchRenewInterval)
+	defer renewTicker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-renewTicker.C:
+				if _, err := registerWatch(srv, user, topicName); err != nil {
+					log.Printf("Unable to renew watch: %v", err)
+				}
+			}
+		}
+	}()
+
+	err = sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		var notification pushNotification
+		if err := json.Unmarshal(m.Data, &notification); err != nil {
+			log.Printf("Unable to parse push notification: %v", err)
+			m.Nack()
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		startHistoryId := state.Accounts[user]
+		newHistoryId, err := incrementalSync(srv, user, startHistoryId, providers, configuration, manifest, manifestFile)
+		if err != nil {
+			log.Printf("Unable to process push notification up to history %d: %v", notification.HistoryId, err)
+			m.Nack()
+			return
+		}
+
+		state.Accounts[user] = newHistoryId
+		if err := saveState(stateFile, state); err != nil {
+			log.Printf("Unable to save the sync state: %v", err)
+		}
+		m.Ack()
+	})
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("pub/sub receive failed: %w", err)
+	}
+
+	log.Printf("Stopping watch for %s...", user)
+	if err := srv.Users.Stop(user).Do(); err != nil {
+		return fmt.Errorf("unable to stop watch: %w", err)
+	}
+	return nil
+}